@@ -1,10 +1,17 @@
 package main
 
 import (
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
 	"encoding/json"
+	"encoding/pem"
 	"fmt"
+	"strconv"
 	"time"
 
+	"github.com/golang/protobuf/ptypes"
 	"github.com/hyperledger/fabric/core/chaincode/shim"
 	sc "github.com/hyperledger/fabric/protos/peer"
 )
@@ -13,18 +20,31 @@ import (
 type SmartContract struct {
 }
 
-//Peer defines ths structure of a peer
+//Peer defines ths structure of a peer as tracked inside a transaction
 type Peer struct {
 	PeerID       string `json:"PeerID"`
 	PeerDecision string `json:"PeerDecision"`
+	Signature    string `json:"Signature"`
 }
 
 //Transaction defines the structure of a transaction
 type Transaction struct {
-	TransactionID     string    `json:"TransactionID"`
-	InvolvedPeers     []Peer    `json:"InvolvedPeers"`
-	FinalDecision     string    `json:"FinalDecision"`
-	TransactionExpire time.Time `json:"TransactionExpire"`
+	TransactionID     string       `json:"TransactionID"`
+	InvolvedPeers     []Peer       `json:"InvolvedPeers"`
+	VotingPolicy      VotingPolicy `json:"VotingPolicy"`
+	Phase             string       `json:"Phase"`
+	FinalDecision     string       `json:"FinalDecision"`
+	TransactionExpire time.Time    `json:"TransactionExpire"`
+}
+
+//VotingPolicy defines how a transaction's peer votes are weighed to reach a final decision.
+//Type is one of UnanimousPolicy, ThresholdPolicy or WeightedPolicy; Weights gives each involved
+//peer's vote weight (all 1 for an unweighted threshold); Threshold is the commit-vote weight
+//needed to reach CommitState
+type VotingPolicy struct {
+	Type      string         `json:"Type"`
+	Threshold int            `json:"Threshold"`
+	Weights   map[string]int `json:"Weights"`
 }
 
 //PeerUpdateRequestModel Model to represent a request to update a peers decision
@@ -32,6 +52,8 @@ type PeerUpdateRequestModel struct {
 	TransactionID string `json:"TransactionID"`
 	PeerID        string `json:"PeerID"`
 	Decision      string `json:"Decision"`
+	Phase         string `json:"Phase"`
+	Signature     string `json:"Signature"`
 }
 
 //FinalDecisionResponseModel Model to represent the response model for a final decision request
@@ -40,17 +62,62 @@ type FinalDecisionResponseModel struct {
 	FinalDecision string `json:"FinalDecision"`
 }
 
-//PeerModel represents a peer
+//PagedTransactionsResponse Model to represent a page of transactions returned by queryTransactionsByStatePaged
+type PagedTransactionsResponse struct {
+	Results  []Transaction `json:"Results"`
+	Bookmark string        `json:"Bookmark"`
+}
+
+//TransactionEvent Model for the JSON payload published with every chaincode event
+type TransactionEvent struct {
+	TransactionID string `json:"TransactionID"`
+	PeerID        string `json:"PeerID,omitempty"`
+	PreviousState string `json:"PreviousState"`
+	NewState      string `json:"NewState"`
+	Timestamp     int64  `json:"Timestamp"`
+}
+
+//PeerModel represents a peer registered to take part in the commit process, along with the
+//public key used to verify the signature it casts its votes with
 type PeerModel struct {
-	PeerID string `json:"PeerID"`
+	PeerID    string `json:"PeerID"`
+	PublicKey string `json:"PublicKey"`
 }
 
-//const define constants for transaction states and general keys
+//const define constants for transaction states, 2PC phases and general keys
 const (
 	PendingState       = "P"
 	CommitState        = "C"
 	AbortState         = "A"
 	RegisteredPeersKey = "RegisteredPeers"
+	stateIndex         = "state~txid"
+
+	//EventTransactionCreated fired once addTransaction persists a new transaction
+	EventTransactionCreated = "TransactionCreated"
+	//EventPeerVoted fired once a peer's vote is recorded by makePeerDecision
+	EventPeerVoted = "PeerVoted"
+	//EventTransactionPrepared fired once the votes cast settle the voting policy's outcome and
+	//makePeerDecision moves the transaction into PreparedPhase, so a client knows to call
+	//commitPhase without polling
+	EventTransactionPrepared = "TransactionPrepared"
+	//EventTransactionCommitted fired once a transaction reaches CommitState
+	EventTransactionCommitted = "TransactionCommitted"
+	//EventTransactionAborted fired once a transaction reaches AbortState
+	EventTransactionAborted = "TransactionAborted"
+
+	InitPhase       = "INIT"
+	PreparingPhase  = "PREPARING"
+	PreparedPhase   = "PREPARED"
+	CommittingPhase = "COMMITTING"
+	CommittedPhase  = "COMMITTED"
+	AbortedPhase    = "ABORTED"
+
+	//UnanimousPolicy requires every involved peer to vote commit, as the original fixed behavior did
+	UnanimousPolicy = "unanimous"
+	//ThresholdPolicy requires a caller-supplied count of commit votes, each peer weighing 1 by default
+	ThresholdPolicy = "threshold"
+	//WeightedPolicy requires a caller-supplied total commit-vote weight, using caller-supplied per-peer weights
+	WeightedPolicy = "weighted"
 )
 
 //Init initializes the chaincode
@@ -68,10 +135,24 @@ func (s *SmartContract) Invoke(APIstub shim.ChaincodeStubInterface) sc.Response
 		return s.addTransaction(APIstub, args)
 	case "queryTransaction":
 		return s.queryTransaction(APIstub, args)
+	case "preparePhase":
+		return s.preparePhase(APIstub, args)
 	case "makePeerDecision":
 		return s.makePeerDecision(APIstub, args)
+	case "commitPhase":
+		return s.commitPhase(APIstub, args)
+	case "abortPhase":
+		return s.abortPhase(APIstub, args)
 	case "queryFinalDecision":
 		return s.queryFinalDecision(APIstub, args)
+	case "getTransactionHistory":
+		return s.getTransactionHistory(APIstub, args)
+	case "queryTransactionsByState":
+		return s.queryTransactionsByState(APIstub, args)
+	case "queryTransactionsByStatePaged":
+		return s.queryTransactionsByStatePaged(APIstub, args)
+	case "sweepExpiredTransactions":
+		return s.sweepExpiredTransactions(APIstub, args)
 	case "registerPeer":
 		return s.registerPeer(APIstub, args)
 	case "getRegisteredPeers":
@@ -102,11 +183,12 @@ func (s *SmartContract) queryTransaction(APIstub shim.ChaincodeStubInterface, ar
 	return shim.Success(trans)
 }
 
-//addTransaction creates a new transaction for the blockchain
+//addTransaction creates a new transaction for the blockchain, starting it in the INIT phase
+//with the caller-supplied expiry rather than a fixed duration
 func (s *SmartContract) addTransaction(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
 
-	if len(args) <= 0 {
-		return shim.Error("Invalid arguments")
+	if len(args) != 2 {
+		return shim.Error("Invalid arguments. Expecting transaction payload and expiry in minutes")
 	}
 
 	var currentTrans Transaction
@@ -123,26 +205,76 @@ func (s *SmartContract) addTransaction(APIstub shim.ChaincodeStubInterface, args
 		return shim.Error("There are no peers involved in the transaction")
 	}
 
+	if err := s.validateVotingPolicy(&currentTrans.VotingPolicy, currentTrans.InvolvedPeers); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	expireMinutes, parseErr := strconv.Atoi(args[1])
+
+	if parseErr != nil || expireMinutes <= 0 {
+		return shim.Error("Invalid expiry. Expecting a positive number of minutes")
+	}
+
+	now, timeErr := s.txTimestamp(APIstub)
+
+	if timeErr != nil {
+		return shim.Error(timeErr.Error())
+	}
+
+	currentTrans.Phase = InitPhase
 	currentTrans.FinalDecision = PendingState
-	currentTrans.TransactionExpire = time.Now().Add(time.Minute * time.Duration(5)).UTC()
+	currentTrans.TransactionExpire = now.Add(time.Minute * time.Duration(expireMinutes))
 
 	for index := range currentTrans.InvolvedPeers {
 
 		currentTrans.InvolvedPeers[index].PeerDecision = PendingState
+		currentTrans.InvolvedPeers[index].Signature = ""
 	}
 
-	transactionBytes, marshalError := json.Marshal(currentTrans)
+	response := s.persistTransaction(APIstub, currentTrans)
 
-	if marshalError != nil {
-		return shim.Error("Internal error while marshalling data")
+	if response.Status != shim.OK {
+		return response
 	}
 
-	APIstub.PutState(currentTrans.TransactionID, transactionBytes)
+	if err := s.emitEvent(APIstub, now, EventTransactionCreated, currentTrans.TransactionID, "", "", PendingState); err != nil {
+		return shim.Error(err.Error())
+	}
 
-	return shim.Success(nil)
+	return response
 }
 
-//makePeerDecision function to update the decision state for each peer
+//preparePhase moves a transaction from INIT into PREPARING so involved peers can start casting votes
+func (s *SmartContract) preparePhase(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 1 {
+		return shim.Error("Invalid number of arguments. Expecting 1")
+	}
+
+	transaction, loadErr := s.loadTransaction(APIstub, args[0])
+
+	if loadErr != nil {
+		return shim.Error(loadErr.Error())
+	}
+
+	if transaction.Phase != InitPhase {
+		return shim.Error("Transaction must be in INIT phase to be prepared")
+	}
+
+	transaction.Phase = PreparingPhase
+
+	return s.persistTransaction(APIstub, transaction)
+}
+
+//makePeerDecision function to update the decision state for each peer. The vote must be cast while
+//the transaction is PREPARING and must carry a signature over (TransactionID, PeerID, Decision, Phase)
+//verified against the peer's registered public key, so a client cannot vote on another peer's behalf.
+//The Phase a vote claims must match the transaction's actual stored phase, so a signature cannot be
+//replayed against a different phase of the same transaction. Once the votes cast settle the voting
+//policy's outcome (commit quorum met, or no longer reachable), which can happen before every peer
+//has voted, the transaction only moves to PREPARED, firing EventTransactionPrepared so a client can react instead
+//of polling; commitPhase or abortPhase perform the actual COMMITTED/ABORTED transition. A vote cast
+//once the transaction has moved past PREPARING is a no-op
 func (s *SmartContract) makePeerDecision(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
 
 	if len(args) <= 0 {
@@ -155,23 +287,17 @@ func (s *SmartContract) makePeerDecision(APIstub shim.ChaincodeStubInterface, ar
 		return shim.Error("Invalid parameter")
 	}
 
-	if currentTrans.TransactionID == "" || !s.checkTransactionIDExistence(APIstub, currentTrans.TransactionID) {
-		return shim.Error("Invalid transactionId")
-	}
-
-	transByte, err := APIstub.GetState(currentTrans.TransactionID)
+	transaction, loadErr := s.loadTransaction(APIstub, currentTrans.TransactionID)
 
-	if err != nil || transByte == nil {
-		return shim.Error("Could not get transaction from persistent state")
+	if loadErr != nil {
+		return shim.Error(loadErr.Error())
 	}
 
-	transaction := Transaction{}
-
-	if err := json.Unmarshal(transByte, &transaction); err != nil {
-		return shim.Error("Internal error with unmarshaling of data")
+	if transaction.Phase == InitPhase {
+		return shim.Error("Transaction must be prepared before votes are accepted")
 	}
 
-	if transaction.FinalDecision != "" && transaction.FinalDecision != PendingState {
+	if transaction.Phase != PreparingPhase {
 		return shim.Success(nil)
 	}
 
@@ -179,6 +305,20 @@ func (s *SmartContract) makePeerDecision(APIstub shim.ChaincodeStubInterface, ar
 		return shim.Error("Invalid number of peers for transaction")
 	}
 
+	if currentTrans.Phase != transaction.Phase {
+		return shim.Error("Vote phase does not match the transaction's current phase")
+	}
+
+	verified, verifyErr := s.verifyPeerVote(APIstub, currentTrans)
+
+	if verifyErr != nil {
+		return shim.Error(verifyErr.Error())
+	}
+
+	if !verified {
+		return shim.Error("Peer signature could not be verified")
+	}
+
 	peerUpdated := false
 
 	for index, elem := range transaction.InvolvedPeers {
@@ -187,6 +327,7 @@ func (s *SmartContract) makePeerDecision(APIstub shim.ChaincodeStubInterface, ar
 		}
 
 		elem.PeerDecision = currentTrans.Decision
+		elem.Signature = currentTrans.Signature
 
 		transaction.InvolvedPeers[index] = elem
 		peerUpdated = true
@@ -197,87 +338,296 @@ func (s *SmartContract) makePeerDecision(APIstub shim.ChaincodeStubInterface, ar
 		return shim.Error("Peer could not be found")
 	}
 
-	if currentTrans.Decision == AbortState {
-		transaction.FinalDecision = AbortState
-		return shim.Success(nil)
+	now, timeErr := s.txTimestamp(APIstub)
+
+	if timeErr != nil {
+		return shim.Error(timeErr.Error())
+	}
+
+	previousState := transaction.FinalDecision
+
+	decision, _ := s.checkPeersVoted(transaction, false, now)
+
+	if decision {
+		transaction.Phase = PreparedPhase
 	}
 
-	decision, state := s.checkPeersVoted(transaction)
+	response := s.persistTransaction(APIstub, transaction)
+
+	if response.Status != shim.OK {
+		return response
+	}
+
+	if err := s.emitEvent(APIstub, now, EventPeerVoted, transaction.TransactionID, currentTrans.PeerID, previousState, transaction.FinalDecision); err != nil {
+		return shim.Error(err.Error())
+	}
 
 	if decision {
+		if err := s.emitEvent(APIstub, now, EventTransactionPrepared, transaction.TransactionID, "", PreparingPhase, PreparedPhase); err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	return response
+}
+
+//commitPhase moves a PREPARED transaction into COMMITTING and evaluates the outcome, aborting any
+//peer still pending past the transaction's expiry. Unlike the prepare phase, a timeout here is fatal
+func (s *SmartContract) commitPhase(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 1 {
+		return shim.Error("Invalid number of arguments. Expecting 1")
+	}
+
+	transaction, loadErr := s.loadTransaction(APIstub, args[0])
+
+	if loadErr != nil {
+		return shim.Error(loadErr.Error())
+	}
+
+	if transaction.Phase != PreparedPhase {
+		return shim.Error("Transaction must be in PREPARED phase to be committed")
+	}
+
+	now, timeErr := s.txTimestamp(APIstub)
+
+	if timeErr != nil {
+		return shim.Error(timeErr.Error())
+	}
+
+	transaction.Phase = CommittingPhase
+	previousState := transaction.FinalDecision
+
+	decision, state := s.checkPeersVoted(transaction, true, now)
+
+	if decision {
+		transaction.Phase = statePhase(state)
 		transaction.FinalDecision = state
 	}
 
-	marshalledUpdate, marshallError := json.Marshal(transaction)
+	response := s.persistTransaction(APIstub, transaction)
 
-	if marshallError != nil {
-		return shim.Error("Internal error while updating transaction")
+	if response.Status != shim.OK {
+		return response
 	}
 
-	APIstub.PutState(transaction.TransactionID, marshalledUpdate)
+	if decision && previousState != state {
+		if err := s.emitFinalDecisionEvent(APIstub, now, transaction.TransactionID, previousState, state); err != nil {
+			return shim.Error(err.Error())
+		}
+	}
 
-	return shim.Success(nil)
+	return response
+}
+
+//abortPhase force-aborts a transaction regardless of its current phase, unless it has already committed
+func (s *SmartContract) abortPhase(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 1 {
+		return shim.Error("Invalid number of arguments. Expecting 1")
+	}
+
+	transaction, loadErr := s.loadTransaction(APIstub, args[0])
+
+	if loadErr != nil {
+		return shim.Error(loadErr.Error())
+	}
+
+	if transaction.Phase == CommittedPhase {
+		return shim.Error("Transaction has already committed and cannot be aborted")
+	}
+
+	now, timeErr := s.txTimestamp(APIstub)
+
+	if timeErr != nil {
+		return shim.Error(timeErr.Error())
+	}
+
+	previousState := transaction.FinalDecision
+
+	transaction.Phase = AbortedPhase
+	transaction.FinalDecision = AbortState
+
+	response := s.persistTransaction(APIstub, transaction)
+
+	if response.Status != shim.OK {
+		return response
+	}
+
+	if previousState != AbortState {
+		if err := s.emitFinalDecisionEvent(APIstub, now, transaction.TransactionID, previousState, AbortState); err != nil {
+			return shim.Error(err.Error())
+		}
+	}
+
+	return response
 }
 
-//checkPeersVoted validates whether the peers have finished voting
-func (s *SmartContract) checkPeersVoted(tran Transaction) (bool, string) {
+//checkPeersVoted evaluates a transaction's VotingPolicy against the votes cast so far. It returns
+//CommitState once the commit-vote weight meets the threshold, AbortState once the peers still
+//pending can no longer push the commit weight to the threshold even if every one of them voted
+//commit, and PendingState otherwise; a transaction with no involved peers yields (false, "").
+//When enforceTimeout is set and now is past the transaction's expiry, peers still pending count as
+//if they had voted abort. now must come from APIstub.GetTxTimestamp() rather than time.Now() so every endorser
+//evaluates the timeout against the same deterministic clock
+func (s *SmartContract) checkPeersVoted(tran Transaction, enforceTimeout bool, now time.Time) (bool, string) {
 
 	if len(tran.InvolvedPeers) <= 0 {
 		return false, ""
 	}
 
-	for _, peer := range tran.InvolvedPeers {
+	expired := enforceTimeout && now.After(tran.TransactionExpire)
+
+	var totalWeight, commitWeight, decidedWeight int
 
-		if peer.PeerDecision != "" && peer.PeerDecision == AbortState {
-			return true, AbortState
-		} else if (peer.PeerDecision == "" || peer.PeerDecision == PendingState) && time.Now().UTC().After(tran.TransactionExpire) {
-			return true, AbortState
-		} else {
-			return false, PendingState
+	for _, peer := range tran.InvolvedPeers {
+		weight := tran.VotingPolicy.Weights[peer.PeerID]
+		totalWeight += weight
+
+		switch {
+		case peer.PeerDecision == CommitState:
+			commitWeight += weight
+			decidedWeight += weight
+		case peer.PeerDecision == AbortState:
+			decidedWeight += weight
+		case expired:
+			decidedWeight += weight
 		}
 	}
 
-	return true, CommitState
+	threshold := tran.VotingPolicy.Threshold
+
+	if commitWeight >= threshold {
+		return true, CommitState
+	}
+
+	if totalWeight-decidedWeight+commitWeight < threshold {
+		return true, AbortState
+	}
+
+	return false, PendingState
 }
 
-func (s *SmartContract) queryFinalDecision(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
-	if len(args) <= 0 {
-		return shim.Error("Invalid parameter number")
+//validateVotingPolicy normalizes and validates a transaction's voting policy in place. An empty
+//Type defaults to UnanimousPolicy (every involved peer weighing 1, threshold equal to the peer
+//count), matching the strict unanimity the coordinator previously enforced unconditionally.
+//A threshold policy with no Weights gives every involved peer a weight of 1. Weighted policies, and
+//threshold policies that supply Weights, must give a non-negative weight for every involved peer;
+//both must supply a threshold within (0, total weight]. InvolvedPeers must not repeat a PeerID, since checkPeersVoted
+//would otherwise count that peer's weight once per occurrence while only one occurrence can ever
+//be voted on
+func (s *SmartContract) validateVotingPolicy(policy *VotingPolicy, peers []Peer) error {
+
+	seenPeers := make(map[string]bool, len(peers))
+
+	for _, peer := range peers {
+		if seenPeers[peer.PeerID] {
+			return fmt.Errorf("involved peers must not contain a duplicate peer id")
+		}
+
+		seenPeers[peer.PeerID] = true
 	}
 
-	transID := args[0]
-	if !s.checkTransactionIDExistence(APIstub, transID) {
-		return shim.Error("Transaction does not exist")
+	if policy.Type == "" {
+		policy.Type = UnanimousPolicy
 	}
 
-	trans, err := APIstub.GetState(transID)
+	if policy.Type == UnanimousPolicy {
+		policy.Weights = make(map[string]int, len(peers))
 
-	if err != nil {
-		return shim.Error("Internal error while getting the transaction")
+		for _, peer := range peers {
+			policy.Weights[peer.PeerID] = 1
+		}
+
+		policy.Threshold = len(peers)
+
+		return nil
 	}
 
-	scTrans := Transaction{}
+	if policy.Type != ThresholdPolicy && policy.Type != WeightedPolicy {
+		return fmt.Errorf("unknown voting policy type")
+	}
 
-	if unmarshalErr := json.Unmarshal(trans, &scTrans); unmarshalErr != nil {
-		return shim.Error("Internal error while unmarshalling data")
+	if policy.Type == ThresholdPolicy && len(policy.Weights) == 0 {
+		policy.Weights = make(map[string]int, len(peers))
+
+		for _, peer := range peers {
+			policy.Weights[peer.PeerID] = 1
+		}
 	}
 
-	if scTrans.TransactionID == "" {
-		return shim.Error("Internal error while getting transaction")
+	totalWeight := 0
+
+	for _, peer := range peers {
+		weight, ok := policy.Weights[peer.PeerID]
+
+		if !ok {
+			return fmt.Errorf("voting policy weights must cover every involved peer")
+		}
+
+		if weight < 0 {
+			return fmt.Errorf("voting policy weights must not be negative")
+		}
+
+		totalWeight += weight
 	}
 
-	decision, state := s.checkPeersVoted(scTrans)
+	if policy.Threshold <= 0 || policy.Threshold > totalWeight {
+		return fmt.Errorf("voting policy threshold must be within (0, total weight]")
+	}
 
-	if decision {
-		scTrans.FinalDecision = state
+	return nil
+}
 
-		marshalledUpdate, marshallError := json.Marshal(scTrans)
+//statePhase maps a final decision state to its corresponding 2PC phase
+func statePhase(state string) string {
+	if state == CommitState {
+		return CommittedPhase
+	}
 
-		if marshallError != nil {
-			return shim.Error("Internal error while updating transaction")
+	return AbortedPhase
+}
+
+//queryFinalDecision reports a transaction's current FinalDecision. Once voting has concluded
+//(Phase is PREPARED or COMMITTING) it also lazily re-evaluates the quorum with the timeout
+//enforced and persists/emits the outcome if that settles it, the same recompute commitPhase
+//performs, so a caller doesn't have to invoke commitPhase just to observe an expired transaction
+//abort. Outside of those phases this is a pure read: it never mutates or emits an event
+func (s *SmartContract) queryFinalDecision(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+	if len(args) <= 0 {
+		return shim.Error("Invalid parameter number")
+	}
+
+	scTrans, loadErr := s.loadTransaction(APIstub, args[0])
+
+	if loadErr != nil {
+		return shim.Error(loadErr.Error())
+	}
+
+	if scTrans.Phase == PreparedPhase || scTrans.Phase == CommittingPhase {
+		now, timeErr := s.txTimestamp(APIstub)
+
+		if timeErr != nil {
+			return shim.Error(timeErr.Error())
 		}
 
-		APIstub.PutState(scTrans.TransactionID, marshalledUpdate)
+		previousState := scTrans.FinalDecision
+		decision, state := s.checkPeersVoted(scTrans, true, now)
+
+		if decision {
+			scTrans.Phase = statePhase(state)
+			scTrans.FinalDecision = state
+
+			if response := s.persistTransaction(APIstub, scTrans); response.Status != shim.OK {
+				return response
+			}
+
+			if previousState != state {
+				if err := s.emitFinalDecisionEvent(APIstub, now, scTrans.TransactionID, previousState, state); err != nil {
+					return shim.Error(err.Error())
+				}
+			}
+		}
 	}
 
 	var finalDecision = FinalDecisionResponseModel{TransactionID: scTrans.TransactionID, FinalDecision: scTrans.FinalDecision}
@@ -303,17 +653,478 @@ func (s *SmartContract) checkTransactionIDExistence(APIstub shim.ChaincodeStubIn
 	return true
 }
 
-//registerPeer used to register a new peer into the list of peers registered in the commit process
+//loadTransaction reads and unmarshals a transaction from persistent state
+func (s *SmartContract) loadTransaction(APIstub shim.ChaincodeStubInterface, transactionID string) (Transaction, error) {
+
+	transaction := Transaction{}
+
+	if transactionID == "" || !s.checkTransactionIDExistence(APIstub, transactionID) {
+		return transaction, fmt.Errorf("invalid transactionId")
+	}
+
+	transByte, err := APIstub.GetState(transactionID)
+
+	if err != nil || transByte == nil {
+		return transaction, fmt.Errorf("could not get transaction from persistent state")
+	}
+
+	if err := json.Unmarshal(transByte, &transaction); err != nil {
+		return transaction, fmt.Errorf("internal error with unmarshaling of data")
+	}
+
+	return transaction, nil
+}
+
+//persistTransaction marshals a transaction, keeps its state~txid composite-key index in sync, and
+//writes it back to persistent state
+func (s *SmartContract) persistTransaction(APIstub shim.ChaincodeStubInterface, transaction Transaction) sc.Response {
+
+	if err := s.updateStateIndex(APIstub, transaction); err != nil {
+		return shim.Error(err.Error())
+	}
+
+	marshalledUpdate, marshallError := json.Marshal(transaction)
+
+	if marshallError != nil {
+		return shim.Error("Internal error while updating transaction")
+	}
+
+	APIstub.PutState(transaction.TransactionID, marshalledUpdate)
+
+	return shim.Success(nil)
+}
+
+//emitEvent publishes a stable JSON event so off-chain SDK clients registered via
+//channel.registerChaincodeEvent can react to a transaction's state transitions instead of
+//polling queryFinalDecision. now should come from txTimestamp so the recorded timestamp is
+//deterministic across endorsers
+func (s *SmartContract) emitEvent(APIstub shim.ChaincodeStubInterface, now time.Time, name string, transactionID string, peerID string, previousState string, newState string) error {
+
+	event := TransactionEvent{
+		TransactionID: transactionID,
+		PeerID:        peerID,
+		PreviousState: previousState,
+		NewState:      newState,
+		Timestamp:     now.Unix(),
+	}
+
+	eventBytes, err := json.Marshal(event)
+
+	if err != nil {
+		return fmt.Errorf("error marshalling event payload")
+	}
+
+	return APIstub.SetEvent(name, eventBytes)
+}
+
+//emitFinalDecisionEvent emits TransactionCommitted or TransactionAborted depending on the state reached
+func (s *SmartContract) emitFinalDecisionEvent(APIstub shim.ChaincodeStubInterface, now time.Time, transactionID string, previousState string, newState string) error {
+
+	eventName := EventTransactionAborted
+
+	if newState == CommitState {
+		eventName = EventTransactionCommitted
+	}
+
+	return s.emitEvent(APIstub, now, eventName, transactionID, "", previousState, newState)
+}
+
+//txTimestamp returns the deterministic transaction timestamp every endorser agrees on, in place of
+//time.Now() which would cause endorsement mismatches on a real Fabric channel
+func (s *SmartContract) txTimestamp(APIstub shim.ChaincodeStubInterface) (time.Time, error) {
+
+	txTimestamp, err := APIstub.GetTxTimestamp()
+
+	if err != nil {
+		return time.Time{}, fmt.Errorf("error retrieving transaction timestamp")
+	}
+
+	txTime, err := ptypes.Timestamp(txTimestamp)
+
+	if err != nil {
+		return time.Time{}, fmt.Errorf("error converting transaction timestamp")
+	}
+
+	return txTime.UTC(), nil
+}
+
+//updateStateIndex removes the state~txid composite-key entry for a transaction's previously
+//persisted FinalDecision, if any, and adds one for its current FinalDecision, so
+//queryTransactionsByState and queryTransactionsByStatePaged can list transactions without
+//knowing their ids up front
+func (s *SmartContract) updateStateIndex(APIstub shim.ChaincodeStubInterface, transaction Transaction) error {
+
+	if existing, loadErr := s.loadTransaction(APIstub, transaction.TransactionID); loadErr == nil && existing.FinalDecision != transaction.FinalDecision {
+		oldKey, err := APIstub.CreateCompositeKey(stateIndex, []string{existing.FinalDecision, existing.TransactionID})
+
+		if err != nil {
+			return fmt.Errorf("error building state index key")
+		}
+
+		if err := APIstub.DelState(oldKey); err != nil {
+			return fmt.Errorf("error removing previous state index entry")
+		}
+	}
+
+	newKey, err := APIstub.CreateCompositeKey(stateIndex, []string{transaction.FinalDecision, transaction.TransactionID})
+
+	if err != nil {
+		return fmt.Errorf("error building state index key")
+	}
+
+	if err := APIstub.PutState(newKey, []byte{0x00}); err != nil {
+		return fmt.Errorf("error writing state index entry")
+	}
+
+	return nil
+}
+
+//getTransactionHistory returns every historic value a transaction key has held, using Fabric's
+//built-in history index, so clients can audit every state change without polling queryFinalDecision
+func (s *SmartContract) getTransactionHistory(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 1 {
+		return shim.Error("Invalid number of arguments. Expecting 1")
+	}
+
+	historyIterator, err := APIstub.GetHistoryForKey(args[0])
+
+	if err != nil {
+		return shim.Error("Error retrieving transaction history")
+	}
+	defer historyIterator.Close()
+
+	var history []Transaction
+
+	for historyIterator.HasNext() {
+		modification, err := historyIterator.Next()
+
+		if err != nil {
+			return shim.Error("Error iterating transaction history")
+		}
+
+		transaction := Transaction{}
+
+		if err := json.Unmarshal(modification.Value, &transaction); err != nil {
+			continue
+		}
+
+		history = append(history, transaction)
+	}
+
+	historyBytes, marshalError := json.Marshal(history)
+
+	if marshalError != nil {
+		return shim.Error("Internal error while marshalling transaction history")
+	}
+
+	return shim.Success(historyBytes)
+}
+
+//queryTransactionsByState returns every transaction currently in the given FinalDecision state using
+//a CouchDB rich query, so clients can list Pending/Aborted/Committed transactions without knowing
+//their ids up front
+func (s *SmartContract) queryTransactionsByState(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 1 {
+		return shim.Error("Invalid number of arguments. Expecting 1")
+	}
+
+	if args[0] != PendingState && args[0] != CommitState && args[0] != AbortState {
+		return shim.Error("Invalid state. Expecting P, C or A")
+	}
+
+	selector := fmt.Sprintf(`{"selector":{"FinalDecision":"%s"}}`, args[0])
+
+	resultsIterator, err := APIstub.GetQueryResult(selector)
+
+	if err != nil {
+		return shim.Error("Error executing rich query")
+	}
+	defer resultsIterator.Close()
+
+	transactions, collectErr := s.collectTransactions(resultsIterator)
+
+	if collectErr != nil {
+		return shim.Error(collectErr.Error())
+	}
+
+	transactionsBytes, marshalError := json.Marshal(transactions)
+
+	if marshalError != nil {
+		return shim.Error("Internal error while marshalling transactions")
+	}
+
+	return shim.Success(transactionsBytes)
+}
+
+//queryTransactionsByStatePaged is the paginated variant of queryTransactionsByState for large result
+//sets. It walks the state~txid composite index directly instead of issuing a rich query, so
+//pagination works the same way on a ledger backed by either LevelDB or CouchDB
+func (s *SmartContract) queryTransactionsByStatePaged(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 3 {
+		return shim.Error("Invalid number of arguments. Expecting state, page size and bookmark")
+	}
+
+	pageSize, parseErr := strconv.Atoi(args[1])
+
+	if parseErr != nil || pageSize <= 0 {
+		return shim.Error("Invalid page size. Expecting a positive number")
+	}
+
+	resultsIterator, metadata, err := APIstub.GetStateByPartialCompositeKeyWithPagination(stateIndex, []string{args[0]}, int32(pageSize), args[2])
+
+	if err != nil {
+		return shim.Error("Error executing paginated query")
+	}
+	defer resultsIterator.Close()
+
+	var transactions []Transaction
+
+	for resultsIterator.HasNext() {
+		entry, nextErr := resultsIterator.Next()
+
+		if nextErr != nil {
+			return shim.Error("Error iterating paginated results")
+		}
+
+		_, keyParts, splitErr := APIstub.SplitCompositeKey(entry.Key)
+
+		if splitErr != nil || len(keyParts) != 2 {
+			continue
+		}
+
+		transaction, loadErr := s.loadTransaction(APIstub, keyParts[1])
+
+		if loadErr != nil {
+			continue
+		}
+
+		transactions = append(transactions, transaction)
+	}
+
+	page := PagedTransactionsResponse{Results: transactions, Bookmark: metadata.GetBookmark()}
+
+	pageBytes, marshalError := json.Marshal(page)
+
+	if marshalError != nil {
+		return shim.Error("Internal error while marshalling transaction page")
+	}
+
+	return shim.Success(pageBytes)
+}
+
+//sweepExpiredTransactions aborts up to limit Pending transactions whose expiry is before the
+//current deterministic transaction timestamp, emitting TransactionAborted for each one, and
+//returns the ids it aborted. Lets an operator run a cron-style client to keep ledger state clean
+//instead of relying on a lazy caller to trigger the abort through queryFinalDecision, which only
+//enforces the expiry once a transaction has reached PREPARED
+func (s *SmartContract) sweepExpiredTransactions(APIstub shim.ChaincodeStubInterface, args []string) sc.Response {
+
+	if len(args) != 1 {
+		return shim.Error("Invalid number of arguments. Expecting a limit")
+	}
+
+	limit, parseErr := strconv.Atoi(args[0])
+
+	if parseErr != nil || limit <= 0 {
+		return shim.Error("Invalid limit. Expecting a positive number")
+	}
+
+	now, timeErr := s.txTimestamp(APIstub)
+
+	if timeErr != nil {
+		return shim.Error(timeErr.Error())
+	}
+
+	resultsIterator, err := APIstub.GetStateByPartialCompositeKey(stateIndex, []string{PendingState})
+
+	if err != nil {
+		return shim.Error("Error scanning pending transactions")
+	}
+	defer resultsIterator.Close()
+
+	abortedIDs := []string{}
+
+	for resultsIterator.HasNext() && len(abortedIDs) < limit {
+		entry, nextErr := resultsIterator.Next()
+
+		if nextErr != nil {
+			return shim.Error("Error iterating pending transactions")
+		}
+
+		_, keyParts, splitErr := APIstub.SplitCompositeKey(entry.Key)
+
+		if splitErr != nil || len(keyParts) != 2 {
+			continue
+		}
+
+		transaction, loadErr := s.loadTransaction(APIstub, keyParts[1])
+
+		if loadErr != nil || !now.After(transaction.TransactionExpire) {
+			continue
+		}
+
+		previousState := transaction.FinalDecision
+		transaction.Phase = AbortedPhase
+		transaction.FinalDecision = AbortState
+
+		response := s.persistTransaction(APIstub, transaction)
+
+		if response.Status != shim.OK {
+			return response
+		}
+
+		if err := s.emitFinalDecisionEvent(APIstub, now, transaction.TransactionID, previousState, AbortState); err != nil {
+			return shim.Error(err.Error())
+		}
+
+		abortedIDs = append(abortedIDs, transaction.TransactionID)
+	}
+
+	abortedBytes, marshalError := json.Marshal(abortedIDs)
+
+	if marshalError != nil {
+		return shim.Error("Internal error while marshalling aborted transaction ids")
+	}
+
+	return shim.Success(abortedBytes)
+}
+
+//collectTransactions drains a state query iterator into a slice of transactions
+func (s *SmartContract) collectTransactions(resultsIterator shim.StateQueryIteratorInterface) ([]Transaction, error) {
+
+	var transactions []Transaction
+
+	for resultsIterator.HasNext() {
+		result, err := resultsIterator.Next()
+
+		if err != nil {
+			return nil, fmt.Errorf("error iterating query results")
+		}
+
+		transaction := Transaction{}
+
+		if err := json.Unmarshal(result.Value, &transaction); err != nil {
+			continue
+		}
+
+		transactions = append(transactions, transaction)
+	}
+
+	return transactions, nil
+}
+
+//verifyPeerVote verifies that a peer vote is signed with the peer's registered public key
+func (s *SmartContract) verifyPeerVote(APIstub shim.ChaincodeStubInterface, vote PeerUpdateRequestModel) (bool, error) {
+
+	peerModel, err := s.getPeerModel(APIstub, vote.PeerID)
+
+	if err != nil {
+		return false, err
+	}
+
+	pubKey, err := parsePublicKey(peerModel.PublicKey)
+
+	if err != nil {
+		return false, err
+	}
+
+	signature, err := base64.StdEncoding.DecodeString(vote.Signature)
+
+	if err != nil {
+		return false, fmt.Errorf("invalid signature encoding")
+	}
+
+	payload := []byte(vote.TransactionID + "|" + vote.PeerID + "|" + vote.Decision + "|" + vote.Phase)
+	digest := sha256.Sum256(payload)
+
+	return ecdsa.VerifyASN1(pubKey, digest[:], signature), nil
+}
+
+//getPeerModel looks up a registered peer by id
+func (s *SmartContract) getPeerModel(APIstub shim.ChaincodeStubInterface, peerID string) (PeerModel, error) {
+
+	peers, err := s.getRegisteredPeerModels(APIstub)
+
+	if err != nil {
+		return PeerModel{}, err
+	}
+
+	for _, peer := range peers {
+		if peer.PeerID == peerID {
+			return peer, nil
+		}
+	}
+
+	return PeerModel{}, fmt.Errorf("peer is not registered")
+}
+
+//getRegisteredPeerModels loads and unmarshals the list of registered peers
+func (s *SmartContract) getRegisteredPeerModels(APIstub shim.ChaincodeStubInterface) ([]PeerModel, error) {
+
+	peersBytes, err := APIstub.GetState(RegisteredPeersKey)
+
+	if err != nil {
+		return nil, fmt.Errorf("error retrieving registered peers")
+	}
+
+	peers := []PeerModel{}
+
+	if peersBytes == nil {
+		return peers, nil
+	}
+
+	if err := json.Unmarshal(peersBytes, &peers); err != nil {
+		return nil, fmt.Errorf("error parsing registered peers")
+	}
+
+	return peers, nil
+}
+
+//parsePublicKey decodes a PEM or base64-encoded DER public key into an ECDSA public key
+func parsePublicKey(encoded string) (*ecdsa.PublicKey, error) {
+
+	der := []byte(encoded)
+
+	if block, _ := pem.Decode([]byte(encoded)); block != nil {
+		der = block.Bytes
+	} else if decoded, err := base64.StdEncoding.DecodeString(encoded); err == nil {
+		der = decoded
+	}
+
+	parsed, err := x509.ParsePKIXPublicKey(der)
+
+	if err != nil {
+		return nil, fmt.Errorf("invalid public key")
+	}
+
+	pubKey, ok := parsed.(*ecdsa.PublicKey)
+
+	if !ok {
+		return nil, fmt.Errorf("public key is not ECDSA")
+	}
+
+	return pubKey, nil
+}
+
+//registerPeer used to register a new peer, along with the public key it signs its votes with,
+//into the list of peers registered in the commit process
 func (s *SmartContract) registerPeer(stub shim.ChaincodeStubInterface, args []string) sc.Response {
-	if len(args) <= 0 {
-		return shim.Error("Invalid parameters")
+	if len(args) != 2 {
+		return shim.Error("Invalid parameters. Expecting peer id and public key")
+	}
+
+	if _, err := parsePublicKey(args[1]); err != nil {
+		return shim.Error("Invalid public key")
 	}
 
 	currentPeers, err := stub.GetState(RegisteredPeersKey)
 
 	if err != nil || currentPeers == nil {
 		newPeers := []PeerModel{}
-		newPeers = append(newPeers, PeerModel{PeerID: args[0]})
+		newPeers = append(newPeers, PeerModel{PeerID: args[0], PublicKey: args[1]})
 		marshalledPeer, marshalErr := json.Marshal(newPeers)
 
 		if marshalErr != nil {
@@ -328,7 +1139,7 @@ func (s *SmartContract) registerPeer(stub shim.ChaincodeStubInterface, args []st
 			return shim.Error("Error while retrieving data")
 		}
 
-		unmarshalled = append(unmarshalled, PeerModel{PeerID: args[0]})
+		unmarshalled = append(unmarshalled, PeerModel{PeerID: args[0], PublicKey: args[1]})
 
 		updatedMarshal, updatedErr := json.Marshal(unmarshalled)
 
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/hyperledger/fabric/core/chaincode/shim"
+	pb "github.com/hyperledger/fabric/protos/peer"
+)
+
+//TestCheckPeersVotedQuorum exercises checkPeersVoted's unanimous, BFT-style threshold and
+//weighted quorum math, including the enforced-timeout abort path
+func TestCheckPeersVotedQuorum(t *testing.T) {
+
+	now := time.Unix(1000, 0)
+	expire := now.Add(time.Hour)
+
+	cases := []struct {
+		name           string
+		policy         VotingPolicy
+		peers          []Peer
+		enforceTimeout bool
+		expired        bool
+		wantDecision   bool
+		wantState      string
+	}{
+		{
+			name:   "unanimous pending until every peer votes",
+			policy: VotingPolicy{Type: UnanimousPolicy, Threshold: 3, Weights: map[string]int{"p1": 1, "p2": 1, "p3": 1}},
+			peers: []Peer{
+				{PeerID: "p1", PeerDecision: CommitState},
+				{PeerID: "p2", PeerDecision: PendingState},
+				{PeerID: "p3", PeerDecision: PendingState},
+			},
+			wantDecision: false,
+			wantState:    PendingState,
+		},
+		{
+			name:   "unanimous commits once every peer votes commit",
+			policy: VotingPolicy{Type: UnanimousPolicy, Threshold: 3, Weights: map[string]int{"p1": 1, "p2": 1, "p3": 1}},
+			peers: []Peer{
+				{PeerID: "p1", PeerDecision: CommitState},
+				{PeerID: "p2", PeerDecision: CommitState},
+				{PeerID: "p3", PeerDecision: CommitState},
+			},
+			wantDecision: true,
+			wantState:    CommitState,
+		},
+		{
+			name:   "unanimous aborts as soon as a single peer votes abort",
+			policy: VotingPolicy{Type: UnanimousPolicy, Threshold: 3, Weights: map[string]int{"p1": 1, "p2": 1, "p3": 1}},
+			peers: []Peer{
+				{PeerID: "p1", PeerDecision: CommitState},
+				{PeerID: "p2", PeerDecision: AbortState},
+				{PeerID: "p3", PeerDecision: PendingState},
+			},
+			wantDecision: true,
+			wantState:    AbortState,
+		},
+		{
+			name:   "threshold commits once a 2f+1 quorum of 4 peers (f=1) votes commit",
+			policy: VotingPolicy{Type: ThresholdPolicy, Threshold: 3, Weights: map[string]int{"p1": 1, "p2": 1, "p3": 1, "p4": 1}},
+			peers: []Peer{
+				{PeerID: "p1", PeerDecision: CommitState},
+				{PeerID: "p2", PeerDecision: CommitState},
+				{PeerID: "p3", PeerDecision: CommitState},
+				{PeerID: "p4", PeerDecision: PendingState},
+			},
+			wantDecision: true,
+			wantState:    CommitState,
+		},
+		{
+			name:   "threshold pending while a commit quorum is still reachable",
+			policy: VotingPolicy{Type: ThresholdPolicy, Threshold: 2, Weights: map[string]int{"p1": 1, "p2": 1, "p3": 1}},
+			peers: []Peer{
+				{PeerID: "p1", PeerDecision: CommitState},
+				{PeerID: "p2", PeerDecision: PendingState},
+				{PeerID: "p3", PeerDecision: PendingState},
+			},
+			wantDecision: false,
+			wantState:    PendingState,
+		},
+		{
+			name:   "threshold aborts once the remaining pending votes can no longer reach quorum",
+			policy: VotingPolicy{Type: ThresholdPolicy, Threshold: 2, Weights: map[string]int{"p1": 1, "p2": 1, "p3": 1}},
+			peers: []Peer{
+				{PeerID: "p1", PeerDecision: AbortState},
+				{PeerID: "p2", PeerDecision: AbortState},
+				{PeerID: "p3", PeerDecision: PendingState},
+			},
+			wantDecision: true,
+			wantState:    AbortState,
+		},
+		{
+			name:   "weighted commits once the heavier peers reach the threshold",
+			policy: VotingPolicy{Type: WeightedPolicy, Threshold: 5, Weights: map[string]int{"p1": 3, "p2": 3, "p3": 1}},
+			peers: []Peer{
+				{PeerID: "p1", PeerDecision: CommitState},
+				{PeerID: "p2", PeerDecision: CommitState},
+				{PeerID: "p3", PeerDecision: PendingState},
+			},
+			wantDecision: true,
+			wantState:    CommitState,
+		},
+		{
+			name:   "weighted pending when a light peer's vote alone cannot decide the outcome",
+			policy: VotingPolicy{Type: WeightedPolicy, Threshold: 5, Weights: map[string]int{"p1": 3, "p2": 3, "p3": 1}},
+			peers: []Peer{
+				{PeerID: "p1", PeerDecision: PendingState},
+				{PeerID: "p2", PeerDecision: PendingState},
+				{PeerID: "p3", PeerDecision: CommitState},
+			},
+			wantDecision: false,
+			wantState:    PendingState,
+		},
+		{
+			name:           "non-enforced timeout leaves an expired transaction pending",
+			enforceTimeout: false,
+			expired:        true,
+			policy:         VotingPolicy{Type: UnanimousPolicy, Threshold: 2, Weights: map[string]int{"p1": 1, "p2": 1}},
+			peers: []Peer{
+				{PeerID: "p1", PeerDecision: CommitState},
+				{PeerID: "p2", PeerDecision: PendingState},
+			},
+			wantDecision: false,
+			wantState:    PendingState,
+		},
+		{
+			name:           "enforced timeout aborts a transaction with peers still pending past expiry",
+			enforceTimeout: true,
+			expired:        true,
+			policy:         VotingPolicy{Type: UnanimousPolicy, Threshold: 2, Weights: map[string]int{"p1": 1, "p2": 1}},
+			peers: []Peer{
+				{PeerID: "p1", PeerDecision: CommitState},
+				{PeerID: "p2", PeerDecision: PendingState},
+			},
+			wantDecision: true,
+			wantState:    AbortState,
+		},
+	}
+
+	contract := &SmartContract{}
+
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+
+			tran := Transaction{
+				VotingPolicy:      tc.policy,
+				InvolvedPeers:     tc.peers,
+				TransactionExpire: expire,
+			}
+
+			evalTime := now
+
+			if tc.expired {
+				evalTime = expire.Add(time.Minute)
+			}
+
+			decision, state := contract.checkPeersVoted(tran, tc.enforceTimeout, evalTime)
+
+			if decision != tc.wantDecision || state != tc.wantState {
+				t.Fatalf("checkPeersVoted() = (%v, %q), want (%v, %q)", decision, state, tc.wantDecision, tc.wantState)
+			}
+		})
+	}
+}
+
+//TestValidateVotingPolicyRejectsNegativeWeights ensures a negative per-peer weight is rejected for
+//both threshold and weighted policies instead of silently skewing the quorum math
+func TestValidateVotingPolicyRejectsNegativeWeights(t *testing.T) {
+
+	contract := &SmartContract{}
+	peers := []Peer{{PeerID: "p1"}, {PeerID: "p2"}}
+
+	policy := VotingPolicy{
+		Type:      WeightedPolicy,
+		Threshold: 1,
+		Weights:   map[string]int{"p1": 1, "p2": -1},
+	}
+
+	if err := contract.validateVotingPolicy(&policy, peers); err == nil {
+		t.Fatalf("expected a negative weight to be rejected")
+	}
+}
+
+//TestValidateVotingPolicyRejectsDuplicatePeers ensures a repeated PeerID in InvolvedPeers is
+//rejected instead of having its weight double-counted by checkPeersVoted
+func TestValidateVotingPolicyRejectsDuplicatePeers(t *testing.T) {
+
+	contract := &SmartContract{}
+	peers := []Peer{{PeerID: "p1"}, {PeerID: "p1"}, {PeerID: "p2"}}
+
+	policy := VotingPolicy{
+		Type:      ThresholdPolicy,
+		Threshold: 2,
+		Weights:   map[string]int{"p1": 1, "p2": 1},
+	}
+
+	if err := contract.validateVotingPolicy(&policy, peers); err == nil {
+		t.Fatalf("expected a duplicate peer id to be rejected")
+	}
+}
+
+//newTestPeer generates an ECDSA P-256 key pair for a test peer, returning the peer id, its
+//base64-encoded SubjectPublicKeyInfo to register and the key to sign its votes with
+func newTestPeer(t *testing.T, peerID string) (string, string, *ecdsa.PrivateKey) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+
+	if err != nil {
+		t.Fatalf("error generating test key: %v", err)
+	}
+
+	der, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+
+	if err != nil {
+		t.Fatalf("error marshalling test public key: %v", err)
+	}
+
+	return peerID, base64.StdEncoding.EncodeToString(der), key
+}
+
+//signVote signs the (TransactionID, PeerID, Decision, Phase) payload verifyPeerVote checks
+func signVote(t *testing.T, key *ecdsa.PrivateKey, transactionID string, peerID string, decision string, phase string) string {
+	t.Helper()
+
+	payload := []byte(transactionID + "|" + peerID + "|" + decision + "|" + phase)
+	digest := sha256.Sum256(payload)
+
+	signature, err := ecdsa.SignASN1(rand.Reader, key, digest[:])
+
+	if err != nil {
+		t.Fatalf("error signing test vote: %v", err)
+	}
+
+	return base64.StdEncoding.EncodeToString(signature)
+}
+
+//invoke calls MockInvoke and fails the test if the chaincode returns an error response
+func invoke(t *testing.T, stub *shim.MockStub, txID string, args ...string) []byte {
+	t.Helper()
+
+	argsBytes := make([][]byte, len(args))
+
+	for i, arg := range args {
+		argsBytes[i] = []byte(arg)
+	}
+
+	response := stub.MockInvoke(txID, argsBytes)
+
+	if response.Status != shim.OK {
+		t.Fatalf("invoke %v failed: %s", args, response.Message)
+	}
+
+	return response.Payload
+}
+
+//subscribeEvents drains every chaincode event queued on the stub so far, emulating an SDK client
+//that subscribed to the chaincode's events
+func subscribeEvents(stub *shim.MockStub) []*pb.ChaincodeEvent {
+
+	var events []*pb.ChaincodeEvent
+
+	for {
+		select {
+		case event := <-stub.ChaincodeEventsChannel:
+			events = append(events, event)
+		default:
+			return events
+		}
+	}
+}
+
+//TestSubscribeEventsOnePerTransition verifies that subscribeEvents sees exactly one event for each
+//of a transaction's transitions: creation, a peer's vote, the quorum being reached and the final
+//commit decision
+func TestSubscribeEventsOnePerTransition(t *testing.T) {
+
+	stub := shim.NewMockStub("2pc", new(SmartContract))
+
+	peerID, peerPub, peerKey := newTestPeer(t, "peerA")
+
+	invoke(t, stub, "tx0", "registerPeer", peerID, peerPub)
+	subscribeEvents(stub)
+
+	txJSON, err := json.Marshal(Transaction{
+		TransactionID: "tx-events",
+		InvolvedPeers: []Peer{{PeerID: peerID}},
+	})
+
+	if err != nil {
+		t.Fatalf("error marshalling test transaction: %v", err)
+	}
+
+	invoke(t, stub, "tx1", "addTransaction", string(txJSON), "5")
+
+	if events := subscribeEvents(stub); len(events) != 1 || events[0].EventName != EventTransactionCreated {
+		t.Fatalf("expected exactly one %s event, got %v", EventTransactionCreated, events)
+	}
+
+	invoke(t, stub, "tx2", "preparePhase", "tx-events")
+
+	if events := subscribeEvents(stub); len(events) != 0 {
+		t.Fatalf("expected preparePhase to emit no event, got %v", events)
+	}
+
+	signature := signVote(t, peerKey, "tx-events", peerID, CommitState, PreparingPhase)
+
+	voteJSON, err := json.Marshal(PeerUpdateRequestModel{
+		TransactionID: "tx-events",
+		PeerID:        peerID,
+		Decision:      CommitState,
+		Phase:         PreparingPhase,
+		Signature:     signature,
+	})
+
+	if err != nil {
+		t.Fatalf("error marshalling test vote: %v", err)
+	}
+
+	invoke(t, stub, "tx3", "makePeerDecision", string(voteJSON))
+
+	events := subscribeEvents(stub)
+
+	if len(events) != 2 || events[0].EventName != EventPeerVoted || events[1].EventName != EventTransactionPrepared {
+		t.Fatalf("expected exactly one %s event followed by one %s event, got %v", EventPeerVoted, EventTransactionPrepared, events)
+	}
+
+	invoke(t, stub, "tx4", "commitPhase", "tx-events")
+
+	if events := subscribeEvents(stub); len(events) != 1 || events[0].EventName != EventTransactionCommitted {
+		t.Fatalf("expected exactly one %s event, got %v", EventTransactionCommitted, events)
+	}
+}
+
+//TestSubscribeEventsNoSpuriousEventOnDuplicateVote verifies that a duplicate makePeerDecision call
+//against a transaction that has already left PREPARING succeeds as a no-op and emits no event
+func TestSubscribeEventsNoSpuriousEventOnDuplicateVote(t *testing.T) {
+
+	stub := shim.NewMockStub("2pc-dup", new(SmartContract))
+
+	peerID, peerPub, peerKey := newTestPeer(t, "peerA")
+
+	invoke(t, stub, "tx0", "registerPeer", peerID, peerPub)
+	subscribeEvents(stub)
+
+	txJSON, err := json.Marshal(Transaction{
+		TransactionID: "tx-dup",
+		InvolvedPeers: []Peer{{PeerID: peerID}},
+	})
+
+	if err != nil {
+		t.Fatalf("error marshalling test transaction: %v", err)
+	}
+
+	invoke(t, stub, "tx1", "addTransaction", string(txJSON), "5")
+	subscribeEvents(stub)
+
+	invoke(t, stub, "tx2", "preparePhase", "tx-dup")
+
+	signature := signVote(t, peerKey, "tx-dup", peerID, CommitState, PreparingPhase)
+
+	voteJSON, err := json.Marshal(PeerUpdateRequestModel{
+		TransactionID: "tx-dup",
+		PeerID:        peerID,
+		Decision:      CommitState,
+		Phase:         PreparingPhase,
+		Signature:     signature,
+	})
+
+	if err != nil {
+		t.Fatalf("error marshalling test vote: %v", err)
+	}
+
+	invoke(t, stub, "tx3", "makePeerDecision", string(voteJSON))
+	subscribeEvents(stub)
+
+	response := stub.MockInvoke("tx4", [][]byte{[]byte("makePeerDecision"), voteJSON})
+
+	if response.Status != shim.OK {
+		t.Fatalf("expected a duplicate vote on an already-prepared transaction to be a no-op, got error: %s", response.Message)
+	}
+
+	if events := subscribeEvents(stub); len(events) != 0 {
+		t.Fatalf("expected no event on a duplicate vote for an already-decided transaction, got %v", events)
+	}
+}